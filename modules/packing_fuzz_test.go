@@ -0,0 +1,67 @@
+//go:build go1.18
+// +build go1.18
+
+package modules
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// fuzzSeed returns n pseudo-random file sizes as fuzzing data. The same seed
+// always returns the same data, so that failures of the seed corpus can be
+// reproduced.
+func fuzzSeed(seed int64, n int) []byte {
+	data := make([]byte, 8*n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// fuzzSizes encodes the file sizes as fuzzing data.
+func fuzzSizes(sizes ...uint64) []byte {
+	data := make([]byte, 8*len(sizes))
+	for i, size := range sizes {
+		binary.LittleEndian.PutUint64(data[8*i:], size-1)
+	}
+	return data
+}
+
+// FuzzPackFiles packs files with sizes derived from the fuzzed data and checks
+// that packing doesn't panic and always produces valid placements.
+func FuzzPackFiles(f *testing.F) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	f.Add(uint8(0), fuzzSizes(1))
+	// Sizes around the alignment brackets and the sector size.
+	f.Add(uint8(1), fuzzSizes(1, 4*kib, 32*kib, 32*kib+1, 512*kib, 4*mib-1, 4*mib))
+	f.Add(uint8(1), fuzzSeed(1, 100))
+	f.Add(uint8(2), fuzzSeed(2, 1000))
+	f.Fuzz(func(t *testing.T, strategy uint8, data []byte) {
+		// Every 8 bytes of data are the size of a file, within (0, SectorSize].
+		files := make(map[string]uint64)
+		for i := 0; i+8 <= len(data); i += 8 {
+			size := binary.LittleEndian.Uint64(data[i:])%SectorSize + 1
+			files[fmt.Sprintf("file%v", i/8)] = size
+		}
+		cfg := PackConfig{Strategy: PackStrategy(strategy % 3)}
+
+		placements, numSectors, err := PackFilesWithConfig(files, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(placements) != len(files) {
+			t.Fatalf("expected %v placements, got %v", len(files), len(placements))
+		}
+		if !FitsInSectors(placements, numSectors) {
+			t.Fatalf("placements don't fit into %v sectors", numSectors)
+		}
+		if err := cfg.ValidatePlacements(placements); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
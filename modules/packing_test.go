@@ -1,14 +1,22 @@
 package modules
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"math/bits"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"text/tabwriter"
 
+	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
 	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/persist"
+	"go.sia.tech/siad/types"
 )
 
 const (
@@ -188,37 +196,1660 @@ func TestPackFilesRandom(t *testing.T) {
 	if len(placements) != numFiles {
 		t.Errorf("expected %v placements, got %v", numFiles, len(placements))
 	}
+	if err := ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that all alignments are correct.
+	for _, p := range placements {
+		size := p.Size
+		requiredAlignment, err := requiredAlignment(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i, j := p.SectorOffset, p.SectorOffset+size-1
+		if i%requiredAlignment != 0 {
+			t.Errorf("invalid alignment for file size %v", size)
+		}
+		if j > SectorSize {
+			t.Errorf("placement outside sector: (%v, %v)", i, j)
+		}
+	}
+
+	// Check that there are no overlapping files.
+	for i, p1 := range placements {
+		for _, p2 := range placements[i+1:] {
+			s1, s2 := p1.SectorIndex, p2.SectorIndex
+			if s1 != s2 {
+				continue
+			}
+
+			i1, i2 := p1.SectorOffset, p1.SectorOffset+p1.Size-1
+			j1, j2 := p2.SectorOffset, p2.SectorOffset+p2.Size-1
+			if overlaps(i1, i2, j1, j2) {
+				t.Errorf("overlapping files at sector%v:(%v, %v) and sector%v:(%v, %v)", s1, i1, i2, s2, j1, j2)
+			}
+		}
+	}
+}
+
+// TestPackFilesDeterministic tests that packing files of equal size always
+// results in the same placements.
+func TestPackFilesDeterministic(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	files := make(map[string]uint64)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("test%v", i)] = 100 * kib
+	}
+	expected, expectedNum, err := PackFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		placements, num, err := PackFiles(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(placements, expected) || num != expectedNum {
+			t.Fatal("packing the same files resulted in different placements")
+		}
+	}
+}
+
+// TestPackFilesPageAlignment tests that every file is aligned to the page
+// alignment of the config.
+func TestPackFilesPageAlignment(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// The page alignment must be a power of two.
+	_, _, err := PackFilesWithConfig(randomFileMap(10), PackConfig{PageAlignment: 3 * kib})
+	if err != ErrInvalidPageAlignment {
+		t.Fatalf("expected %v, got %v", ErrInvalidPageAlignment, err)
+	}
+
+	// Use a page alignment larger than the smallest size-based alignment so
+	// that it matters for small files.
+	pageAlignment := 64 * kib
+	files := randomFileMap(1e3)
+	// Add some small files.
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("small%v", i)] = fastrand.Uint64n(32*kib) + 1
+	}
+	cfg := PackConfig{PageAlignment: pageAlignment}
+	placements, _, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+	if len(placements) != len(files) {
+		t.Fatalf("expected %v placements, got %v", len(files), len(placements))
+	}
+	for _, p := range placements {
+		if p.SectorOffset%pageAlignment != 0 {
+			t.Errorf("file %v at offset %v is not aligned to %v", p.FileID, p.SectorOffset, pageAlignment)
+		}
+		if p.SectorOffset+p.Size > SectorSize {
+			t.Errorf("placement outside sector: (%v, %v)", p.SectorOffset, p.SectorOffset+p.Size)
+		}
+	}
+}
+
+// TestPackFilesAlignmentFunc tests packing files with custom alignment
+// functions.
+func TestPackFilesAlignmentFunc(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// An alignment of zero is invalid.
+	zeroAlignment := func(uint64) (uint64, error) { return 0, nil }
+	_, _, err := PackFilesWithConfig(randomFileMap(10), PackConfig{AlignmentFunc: zeroAlignment})
+	if !errors.Contains(err, ErrInvalidAlignment) {
+		t.Fatalf("expected %v, got %v", ErrInvalidAlignment, err)
+	}
+
+	files := randomFileMap(1e3)
+	_, defaultSectors, err := PackFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without alignment the files are packed at least as densely as with the
+	// default alignment.
+	cfg := PackConfig{AlignmentFunc: func(uint64) (uint64, error) { return 1, nil }}
+	placements, numSectors, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+	if len(placements) != len(files) {
+		t.Fatalf("expected %v placements, got %v", len(files), len(placements))
+	}
+	if numSectors > defaultSectors {
+		t.Fatalf("expected at most %v sectors without alignment, got %v", defaultSectors, numSectors)
+	}
+
+	// Align every file to the same alignment.
+	alignment := 64 * kib
+	cfg = PackConfig{AlignmentFunc: func(uint64) (uint64, error) { return alignment, nil }}
+	placements, _, err = PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range placements {
+		if p.SectorOffset%alignment != 0 {
+			t.Errorf("file %v at offset %v is not aligned to %v", p.FileID, p.SectorOffset, alignment)
+		}
+	}
+}
+
+// TestPackFilesIndex tests that no file is placed in the region reserved for
+// the index at the end of the final sector.
+func TestPackFilesIndex(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	tests := []struct {
+		in        map[string]uint64
+		indexSize uint64
+		num       uint64
+	}{
+		// No files, the index gets its own sector.
+		{in: map[string]uint64{}, indexSize: kib, num: 1},
+		// The index fits behind the file.
+		{in: map[string]uint64{"test1": 10 * kib}, indexSize: kib, num: 1},
+		// The file fills the sector, the index needs a new sector.
+		{in: map[string]uint64{"test1": SectorSize}, indexSize: kib, num: 2},
+		// The index fills a whole sector.
+		{in: map[string]uint64{"test1": 10 * kib}, indexSize: SectorSize, num: 2},
+	}
+
+	for _, test := range tests {
+		cfg := PackConfig{IndexSize: test.indexSize}
+		_, num, err := PackFilesWithConfig(test.in, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if num != test.num {
+			t.Errorf("PackFilesWithConfig(%v, %v): expected %v sectors, got %v", test.in, cfg, test.num, num)
+		}
+		index, ok := cfg.IndexPlacement(num)
+		if !ok || index.SectorIndex != num-1 || index.SectorOffset != SectorSize-test.indexSize || index.Size != test.indexSize {
+			t.Errorf("IndexPlacement(%v): unexpected index %v %v", num, index, ok)
+		}
+	}
+
+	// The index can't be larger than a sector.
+	_, _, err := PackFilesWithConfig(randomFileMap(10), PackConfig{IndexSize: SectorSize + 1})
+	if err != ErrSizeTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSizeTooLarge, err)
+	}
+	// Without an index size there is no index.
+	if _, ok := (PackConfig{}).IndexPlacement(1); ok {
+		t.Fatal("expected no index placement")
+	}
+
+	// Pack random files and make sure none of them overlap the index.
+	for i := 0; i < 10; i++ {
+		cfg := PackConfig{IndexSize: fastrand.Uint64n(SectorSize) + 1}
+		placements, num, err := PackFilesWithConfig(randomFileMap(100), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, ok := cfg.IndexPlacement(num)
+		if !ok {
+			t.Fatal("expected an index placement")
+		}
+		for _, p := range placements {
+			if p.SectorIndex != index.SectorIndex {
+				continue
+			}
+			if overlaps(p.SectorOffset, p.SectorOffset+p.Size-1, index.SectorOffset, SectorSize-1) {
+				t.Errorf("file %v at (%v, %v) overlaps the index at %v", p.FileID, p.SectorOffset, p.Size, index.SectorOffset)
+			}
+		}
+	}
+}
+
+// TestPackFilesMaxSectorIndex tests that files are placed within their maximum
+// sector index or packing fails.
+func TestPackFilesMaxSectorIndex(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	files := map[string]uint64{
+		"test1": 3*mib + 512*kib,
+		"test2": 3 * mib,
+		"test3": 256 * kib,
+	}
+
+	// Without constraints test3 is placed into the larger bucket in sector 1.
+	placements, _, err := PackFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placements[2].FileID != "test3" || placements[2].SectorIndex != 1 {
+		t.Fatalf("expected test3 in sector 1, got %v", placements[2])
+	}
+
+	// Constrain test3 to sector 0.
+	cfg := PackConfig{MaxSectorIndex: map[string]uint64{"test3": 0}}
+	placements, num, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FilePlacement{
+		{FileID: "test1", Size: 3*mib + 512*kib, SectorIndex: 0, SectorOffset: 0},
+		{FileID: "test2", Size: 3 * mib, SectorIndex: 1, SectorOffset: 0},
+		{FileID: "test3", Size: 256 * kib, SectorIndex: 0, SectorOffset: 3*mib + 512*kib},
+	}
+	if !reflect.DeepEqual(placements, expected) || num != 2 {
+		t.Errorf("expected %v %v, got %v %v", expected, 2, placements, num)
+	}
+
+	// test2 would need a second sector but is constrained to the first.
+	cfg = PackConfig{MaxSectorIndex: map[string]uint64{"test2": 0}}
+	_, _, err = PackFilesWithConfig(files, cfg)
+	if !errors.Contains(err, ErrMaxSectorIndexExceeded) || !strings.Contains(err.Error(), "test2") {
+		t.Fatalf("expected %v for test2, got %v", ErrMaxSectorIndexExceeded, err)
+	}
+}
+
+// TestPackFilesMinFileSize tests that files below the minimum file size are
+// rejected.
+func TestPackFilesMinFileSize(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	cfg := PackConfig{MinFileSize: 4 * kib}
+
+	// Files at or above the minimum are packed.
+	files := map[string]uint64{
+		"test1": 4 * kib,
+		"test2": 20 * kib,
+		"test3": mib,
+	}
+	placements, _, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(placements) != len(files) {
+		t.Fatalf("expected %v placements, got %v", len(files), len(placements))
+	}
+
+	// A file below the minimum is rejected, naming the file.
+	files["test4"] = 4*kib - 1
+	_, _, err = PackFilesWithConfig(files, cfg)
+	if !errors.Contains(err, ErrSizeTooSmall) || !strings.Contains(err.Error(), "test4") {
+		t.Fatalf("expected %v for test4, got %v", ErrSizeTooSmall, err)
+	}
+
+	// Zero-sized files are still rejected as such.
+	files["test4"] = 0
+	_, _, err = PackFilesWithConfig(files, cfg)
+	if err != ErrZeroSize {
+		t.Fatalf("expected %v, got %v", ErrZeroSize, err)
+	}
+
+	// The minimum can't exceed a sector.
+	_, _, err = PackFilesWithConfig(files, PackConfig{MinFileSize: SectorSize + 1})
+	if err != ErrSizeTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSizeTooLarge, err)
+	}
+}
+
+// TestPackFilesComparator tests packing files in a custom order.
+func TestPackFilesComparator(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	files := map[string]uint64{
+		"test1": 10 * kib,
+		"test2": 20 * kib,
+		"test3": 15 * kib,
+		"test4": 5 * kib,
+	}
+	priority := map[string]int{
+		"test1": 2,
+		"test2": 1,
+		"test3": 3,
+		"test4": 2,
+	}
+
+	// Pack files with a higher priority first, and files of equal priority by
+	// ID.
+	cfg := PackConfig{
+		Less: func(a, b SizedFile) bool {
+			if priority[a.ID] != priority[b.ID] {
+				return priority[a.ID] > priority[b.ID]
+			}
+			return a.ID < b.ID
+		},
+	}
+	placements, _, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"test3", "test1", "test4", "test2"}
+	for i, p := range placements {
+		if p.FileID != expected[i] {
+			t.Errorf("expected file %v to be %v, got %v", i, expected[i], p.FileID)
+		}
+	}
+
+	// A comparator that doesn't order files of equal priority is rejected in
+	// debug builds.
+	cfg.Less = func(a, b SizedFile) bool {
+		return priority[a.ID] > priority[b.ID]
+	}
+	_, _, err = PackFilesWithConfig(files, cfg)
+	if build.DEBUG && !errors.Contains(err, ErrInvalidComparator) {
+		t.Fatalf("expected %v, got %v", ErrInvalidComparator, err)
+	} else if !build.DEBUG && err != nil {
+		t.Fatal(err)
+	}
+
+	// An intransitive comparator is rejected in debug builds as well. test1
+	// comes before test2, test2 before test3 and test3 before test1.
+	next := map[string]string{"test1": "test2", "test2": "test3", "test3": "test1"}
+	cfg.Less = func(a, b SizedFile) bool {
+		return next[a.ID] == b.ID
+	}
+	delete(files, "test4")
+	_, _, err = PackFilesWithConfig(files, cfg)
+	if build.DEBUG && !errors.Contains(err, ErrInvalidComparator) {
+		t.Fatalf("expected %v, got %v", ErrInvalidComparator, err)
+	} else if !build.DEBUG && err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPackFilesInto tests packing new files into the free space left by
+// existing placements.
+func TestPackFilesInto(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	existingFiles := randomFileMap(50)
+	newFiles := logUniformFileMap(200)
+	existing, _, err := PackFiles(existingFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placements, numSectors, err := PackFilesInto(existing, newFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(placements) != len(existing)+len(newFiles) {
+		t.Fatalf("expected %v placements, got %v", len(existing)+len(newFiles), len(placements))
+	}
+	if !reflect.DeepEqual(placements[:len(existing)], existing) {
+		t.Fatal("existing placements were changed")
+	}
+
+	// The result should be the same as continuing to pack with the Packer
+	// that packed the existing files.
+	p, err := NewPacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PackFiles(existingFiles); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := p.PackFiles(newFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(placements[len(existing):], expected) || numSectors != p.NumSectors() {
+		t.Fatal("packing into existing placements differs from continuing to pack")
+	}
+
+	if err := ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files can't be packed twice.
+	_, _, err = PackFilesInto(existing, map[string]uint64{existing[0].FileID: 1})
+	if !errors.Contains(err, ErrFileAlreadyPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileAlreadyPacked, err)
+	}
+	// Overlapping placements are rejected.
+	overlapping := []FilePlacement{
+		{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: 0},
+		{FileID: "test2", Size: 10 * kib, SectorIndex: 0, SectorOffset: 8 * kib},
+	}
+	_, _, err = PackFilesInto(overlapping, map[string]uint64{"test3": 1})
+	if !errors.Contains(err, ErrInvalidPlacements) {
+		t.Fatalf("expected %v, got %v", ErrInvalidPlacements, err)
+	}
+	// Packing into nothing is the same as PackFiles.
+	placements, _, err = PackFilesInto(nil, existingFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(placements, existing) {
+		t.Fatal("packing into no placements differs from PackFiles")
+	}
+}
+
+// TestPackerRemoveFile tests that removing files frees their space and merges
+// adjacent free buckets.
+func TestPackerRemoveFile(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// checkMerged checks that no two buckets of the packer are adjacent.
+	checkMerged := func(p *Packer) {
+		t.Helper()
+		for i := 1; i < len(p.buckets); i++ {
+			b1, b2 := p.buckets[i-1], p.buckets[i]
+			if b1.sectorIndex == b2.sectorIndex && b1.sectorOffset+b1.length >= b2.sectorOffset {
+				t.Fatalf("buckets %v and %v weren't merged", *b1, *b2)
+			}
+		}
+	}
+
+	files := logUniformFileMap(200)
+	for i := 0; i < 5; i++ {
+		p, err := NewPacker(PackConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		placements, err := p.PackFiles(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numSectors := p.NumSectors()
+
+		// Remove the files in a random order.
+		order := fastrand.Perm(len(placements))
+		ids := make([]string, 0, len(placements))
+		for _, j := range order {
+			ids = append(ids, placements[j].FileID)
+		}
+		for j, id := range ids {
+			if err := p.RemoveFile(id); err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Placements()) != len(ids)-j-1 {
+				t.Fatalf("expected %v placements, got %v", len(ids)-j-1, len(p.Placements()))
+			}
+			checkMerged(p)
+
+			// Halfway through, the space freed by the last removed file
+			// should be reused when packing it again.
+			if j == len(ids)/2 {
+				if _, err := p.PackFiles(map[string]uint64{id: files[id]}); err != nil {
+					t.Fatal(err)
+				}
+				if p.NumSectors() != numSectors {
+					t.Fatalf("expected %v sectors after repacking, got %v", numSectors, p.NumSectors())
+				}
+				checkMerged(p)
+				if err := p.RemoveFile(id); err != nil {
+					t.Fatal(err)
+				}
+				checkMerged(p)
+			}
+		}
+
+		// With all files removed, every sector is a single free bucket.
+		if uint64(len(p.buckets)) != numSectors {
+			t.Fatalf("expected %v buckets, got %v", numSectors, len(p.buckets))
+		}
+		for j, b := range p.buckets {
+			if b.sectorIndex != uint64(j) || b.sectorOffset != 0 || b.length != SectorSize {
+				t.Fatalf("expected bucket %v to fill its sector, got %v", j, *b)
+			}
+		}
+	}
+
+	// Removing a file that isn't packed fails.
+	p, err := NewPacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PackFiles(map[string]uint64{"test1": kib}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveFile("test2"); !errors.Contains(err, ErrFileNotPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileNotPacked, err)
+	}
+	// Removing a file twice fails.
+	if err := p.RemoveFile("test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveFile("test1"); !errors.Contains(err, ErrFileNotPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileNotPacked, err)
+	}
+}
+
+// TestPackerRemoveFilePadding tests that removing a file doesn't free the space
+// of the file after it, even if that file starts within the padding after the
+// removed file.
+func TestPackerRemoveFilePadding(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// Alignments that aren't a multiple of the alignment of a single byte file
+	// are rejected, since files could start within the padding.
+	cfg := PackConfig{
+		Strategy: PackStrategyFirstFit,
+		AlignmentFunc: func(fileSize uint64) (uint64, error) {
+			if fileSize <= 3 {
+				return 3, nil
+			}
+			return 4, nil
+		},
+	}
+	p, err := NewPacker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add("A", 5); !errors.Contains(err, ErrInvalidAlignment) {
+		t.Fatalf("expected %v, got %v", ErrInvalidAlignment, err)
+	}
+
+	// Placements created elsewhere may still start within the padding. B
+	// starts at 7, within the padding up to 8 after C.
+	cfg = PackConfig{
+		Strategy:      PackStrategyFirstFit,
+		AlignmentFunc: func(uint64) (uint64, error) { return 4, nil },
+	}
+	b := FilePlacement{FileID: "B", Size: 5, SectorOffset: 7}
+	p, err = newPackerFromPlacements([]FilePlacement{
+		{FileID: "A", Size: 5, SectorOffset: 0},
+		{FileID: "C", Size: 1, SectorOffset: 6},
+		b,
+	}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveFile("C"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range p.buckets {
+		if bucket.sectorIndex == b.SectorIndex && bucket.sectorOffset < b.SectorOffset+b.Size && b.SectorOffset < bucket.sectorOffset+bucket.length {
+			t.Fatalf("bucket %v overlaps %v", *bucket, b)
+		}
+	}
+	d, err := p.Add("D", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SectorIndex == b.SectorIndex && d.SectorOffset < b.SectorOffset+b.Size && b.SectorOffset < d.SectorOffset+d.Size {
+		t.Fatalf("%v overlaps %v", d, b)
+	}
+}
+
+// TestPackerRemoveFileStalePlacements tests that removing a file only frees the
+// space the Packer placed it at, regardless of what placements the caller
+// holds for it.
+func TestPackerRemoveFileStalePlacements(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	p, err := NewPacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placements, err := p.PackFiles(map[string]uint64{"a": mib, "b": mib})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A ghost file the Packer doesn't know can't be removed, so the space of
+	// b can't be freed through a forged placement at its offset.
+	var b FilePlacement
+	for _, fp := range placements {
+		if fp.FileID == "b" {
+			b = fp
+		}
+	}
+	if err := p.RemoveFile("ghost"); !errors.Contains(err, ErrFileNotPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileNotPacked, err)
+	}
+
+	// Remove a, keeping its placement around. Removing it again through the
+	// stale placement fails.
+	if err := p.RemoveFile("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveFile("a"); !errors.Contains(err, ErrFileNotPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileNotPacked, err)
+	}
+
+	// Files packed afterwards never overlap b.
+	if _, err := p.PackFiles(map[string]uint64{"c": mib, "d": mib, "e": mib}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidatePlacements(p.Placements()); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, fp := range p.Placements() {
+		found = found || fp == b
+	}
+	if !found {
+		t.Fatalf("b was moved from %v", b)
+	}
+}
+
+// TestPackerAdd tests adding files to a Packer one at a time.
+func TestPackerAdd(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	p, err := NewPacker(PackConfig{SplitLargeFiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := randomFileMap(1e3)
+	var placements []FilePlacement
+	for id, size := range files {
+		fp, err := p.Add(id, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fp.FileID != id || fp.Size != size {
+			t.Fatalf("expected placement of %v with size %v, got %v", id, size, fp)
+		}
+		placements = append(placements, fp)
+	}
+	if !reflect.DeepEqual(p.Placements(), placements) {
+		t.Fatal("packer doesn't track the added placements")
+	}
+	if err := ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+	if !FitsInSectors(placements, p.NumSectors()) {
+		t.Fatalf("placements don't fit into %v sectors", p.NumSectors())
+	}
+
+	// Files can't be added twice, neither one at a time nor in a batch.
+	var added string
+	for id := range files {
+		added = id
+		break
+	}
+	if _, err := p.Add(added, kib); !errors.Contains(err, ErrFileAlreadyPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileAlreadyPacked, err)
+	}
+	if _, err := p.PackFiles(map[string]uint64{"new": kib, added: kib}); !errors.Contains(err, ErrFileAlreadyPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileAlreadyPacked, err)
+	}
+	if !reflect.DeepEqual(p.Placements(), placements) {
+		t.Fatal("failed add changed the placements")
+	}
+
+	// Files larger than a sector can't be added, even with splitting enabled.
+	if _, err := p.Add("large", SectorSize+1); err != ErrSizeTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSizeTooLarge, err)
+	}
+	if len(p.Placements()) != len(files) {
+		t.Fatal("failed add changed the placements")
+	}
+
+	// Removed files are no longer tracked.
+	var removed string
+	for id := range files {
+		removed = id
+		break
+	}
+	if err := p.RemoveFile(removed); err != nil {
+		t.Fatal(err)
+	}
+	for _, fp := range p.Placements() {
+		if fp.FileID == removed {
+			t.Fatalf("removed file %v is still tracked", removed)
+		}
+	}
+	// A removed file can be added again.
+	if _, err := p.Add(removed, files[removed]); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a reset the packer starts from scratch.
+	p.Reset()
+	if p.NumSectors() != 0 || len(p.Placements()) != 0 || !reflect.DeepEqual(p.Stats(), computePackingStats(nil, 0)) {
+		t.Fatal("reset packer isn't empty")
+	}
+	fp, err := p.Add("test", SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.SectorIndex != 0 || fp.SectorOffset != 0 || p.NumSectors() != 1 {
+		t.Fatalf("unexpected placement after reset: %v", fp)
+	}
+}
+
+// TestOnlinePacker tests that placing files one at a time produces valid
+// placements within the documented density bound.
+func TestOnlinePacker(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	for _, files := range []map[string]uint64{randomFileMap(2e3), logUniformFileMap(2e3)} {
+		op, err := NewOnlinePacker(PackConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		placements := make([]FilePlacement, 0, len(files))
+		for id, size := range files {
+			p, err := op.Place(id, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.FileID != id || p.Size != size {
+				t.Fatalf("expected placement of %v %v, got %v", id, size, p)
+			}
+			placements = append(placements, p)
+		}
+
+		if err := ValidatePlacements(placements); err != nil {
+			t.Fatal(err)
+		}
+
+		// Compare the density to offline packing. For files in random order
+		// online packing was observed to need only a few percent more
+		// sectors. The factor leaves a generous margin on that observation,
+		// it isn't a guaranteed bound.
+		_, numSectors, err := PackFiles(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if float64(op.NumSectors()) > 1.25*float64(numSectors) {
+			t.Errorf("online packing used %v sectors, offline packing %v", op.NumSectors(), numSectors)
+		}
+	}
+
+	// Invalid files are rejected.
+	op, err := NewOnlinePacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := op.Place("test1", 0); err != ErrZeroSize {
+		t.Fatalf("expected %v, got %v", ErrZeroSize, err)
+	}
+	if _, err := op.Place("test1", SectorSize+1); err != ErrSizeTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSizeTooLarge, err)
+	}
+	// Files can't be placed twice.
+	if _, err := op.Place("test1", kib); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := op.Place("test1", kib); !errors.Contains(err, ErrFileAlreadyPacked) {
+		t.Fatalf("expected %v, got %v", ErrFileAlreadyPacked, err)
+	}
+}
+
+// TestPackingIndex tests looking up packed files by their position.
+func TestPackingIndex(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	placements, numSectors, err := PackFiles(map[string]uint64{
+		"test1": 3 * mib,
+		"test2": 4 * mib,
+		"test3": 1 * mib,
+		"test4": 2 * mib,
+		"test5": 2e3 * kib,
+		"test6": 1,
+		"test7": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := NewPackingIndex(placements)
+
+	tests := []struct {
+		sectorIndex, sectorOffset uint64
+		fileID                    string
+		exists                    bool
+	}{
+		{0, 0, "test2", true},
+		{0, SectorSize - 1, "test2", true},
+		{1, 0, "test1", true},
+		{1, 3*mib - 1, "test1", true},
+		{1, 3 * mib, "test3", true},
+		{2, 2*mib + 2e3*kib, "test7", true},
+		{2, 2*mib + 2e3*kib + 1, "test7", true},
+		// Alignment gap behind test7.
+		{2, 2*mib + 2e3*kib + 2, "", false},
+		{2, 2*mib + 2_004*kib, "test6", true},
+		// Free space at the end of the last sector.
+		{2, SectorSize - 1, "", false},
+		// Sector that doesn't exist.
+		{3, 0, "", false},
+	}
+	for _, test := range tests {
+		fileID, exists := pi.FileAt(test.sectorIndex, test.sectorOffset)
+		if fileID != test.fileID || exists != test.exists {
+			t.Errorf("FileAt(%v, %v): expected %v %v, got %v %v", test.sectorIndex, test.sectorOffset, test.fileID, test.exists, fileID, exists)
+		}
+	}
+
+	// Every placement is found at its first and last byte, and is returned for
+	// its sector.
+	for _, p := range placements {
+		for _, offset := range []uint64{p.SectorOffset, p.SectorOffset + p.Size - 1} {
+			if fileID, exists := pi.FileAt(p.SectorIndex, offset); !exists || fileID != p.FileID {
+				t.Errorf("FileAt(%v, %v): expected %v, got %v %v", p.SectorIndex, offset, p.FileID, fileID, exists)
+			}
+		}
+	}
+	var numPlacements int
+	for sectorIndex := uint64(0); sectorIndex <= numSectors; sectorIndex++ {
+		inSector := pi.PlacementsInSector(sectorIndex)
+		for i, p := range inSector {
+			if p.SectorIndex != sectorIndex {
+				t.Errorf("PlacementsInSector(%v): got placement %v", sectorIndex, p)
+			}
+			if i > 0 && inSector[i-1].SectorOffset >= p.SectorOffset {
+				t.Errorf("PlacementsInSector(%v): placements out of order", sectorIndex)
+			}
+		}
+		numPlacements += len(inSector)
+	}
+	if numPlacements != len(placements) {
+		t.Errorf("expected %v placements in all sectors, got %v", len(placements), numPlacements)
+	}
+	expected := []FilePlacement{placements[1], placements[4]}
+	if inSector := pi.PlacementsInSector(1); !reflect.DeepEqual(inSector, expected) {
+		t.Errorf("PlacementsInSector(1): expected %v, got %v", expected, inSector)
+	}
+}
+
+// TestPackFilesSplitLargeFiles tests that files larger than a sector are split
+// into parts that can be reassembled.
+func TestPackFilesSplitLargeFiles(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	files := map[string]uint64{
+		"test1": 2*SectorSize + 2*mib,
+		"test2": 3 * SectorSize,
+		"test3": mib,
+	}
+
+	// Without splitting, large files are rejected.
+	_, _, err := PackFiles(files)
+	if err != ErrSizeTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSizeTooLarge, err)
+	}
+
+	cfg := PackConfig{SplitLargeFiles: true}
+	placements, num, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The full parts each take a sector, the remainder of test1 shares a
+	// sector with test3.
+	if num != 6 {
+		t.Errorf("expected 6 sectors, got %v", num)
+	}
+
+	// Reassemble the files from their parts.
+	parts := make(map[string][]FilePlacement)
+	for _, p := range placements {
+		parts[p.FileID] = append(parts[p.FileID], p)
+	}
+	for id, size := range files {
+		fileParts := parts[id]
+		sort.Slice(fileParts, func(i, j int) bool {
+			return fileParts[i].PartIndex < fileParts[j].PartIndex
+		})
+		var total uint64
+		for i, p := range fileParts {
+			if size > SectorSize && (p.PartIndex != uint64(i) || p.PartCount != uint64(len(fileParts))) {
+				t.Errorf("unexpected part %v of %v", p, id)
+			}
+			if size <= SectorSize && (p.PartIndex != 0 || p.PartCount != 0) {
+				t.Errorf("unexpected part %v of %v", p, id)
+			}
+			// All parts but the last fill a sector.
+			if i < len(fileParts)-1 && p.Size != SectorSize {
+				t.Errorf("part %v of %v doesn't fill a sector", p, id)
+			}
+			total += p.Size
+		}
+		if total != size {
+			t.Errorf("expected parts of %v to add up to %v, got %v", id, size, total)
+		}
+	}
+
+	// Removing a split file frees all of its parts.
+	p, err := NewPacker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placements, err = p.PackFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveFile("test2"); err != nil {
+		t.Fatal(err)
+	}
+	placements = p.Placements()
+	if len(placements) != len(parts["test1"])+len(parts["test3"]) {
+		t.Fatalf("expected only parts of test1 and test3, got %v", placements)
+	}
+	if _, err := p.PackFiles(map[string]uint64{"test4": 3 * SectorSize}); err != nil || p.NumSectors() != num {
+		t.Fatalf("expected test4 to reuse the sectors of test2, got %v sectors %v", p.NumSectors(), err)
+	}
+}
+
+// TestPackFilesGroupPadding tests that groups are packed into their own
+// sectors, separated by empty padding sectors.
+func TestPackFilesGroupPadding(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	files := map[string]uint64{
+		"test1": 10 * kib,
+		"test2": 20 * kib,
+		"test3": 15 * kib,
+		"test4": 5 * kib,
+	}
+	cfg := PackConfig{
+		Groups: map[string]string{
+			"test1": "b",
+			"test2": "a",
+			"test3": "b",
+			"test4": "a",
+		},
+		GroupPadding: 1,
+	}
+	placements, num, err := PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Group a fills sector 0, sector 1 is padding and group b starts in
+	// sector 2.
+	expected := []FilePlacement{
+		{FileID: "test2", Size: 20 * kib, SectorIndex: 0, SectorOffset: 0},
+		{FileID: "test4", Size: 5 * kib, SectorIndex: 0, SectorOffset: 20 * kib},
+		{FileID: "test3", Size: 15 * kib, SectorIndex: 2, SectorOffset: 0},
+		{FileID: "test1", Size: 10 * kib, SectorIndex: 2, SectorOffset: 16 * kib},
+	}
+	if !reflect.DeepEqual(placements, expected) || num != 3 {
+		t.Fatalf("expected %v %v, got %v %v", expected, 3, placements, num)
+	}
+
+	// Without padding the groups are still packed into separate sectors.
+	cfg.GroupPadding = 0
+	placements, num, err = PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 || placements[2].SectorIndex != 1 || placements[3].SectorIndex != 1 {
+		t.Fatalf("expected group b in sector 1, got %v %v", placements, num)
+	}
+
+	// Files without a group are packed first.
+	delete(cfg.Groups, "test2")
+	placements, _, err = PackFilesWithConfig(files, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placements[0].FileID != "test2" || placements[0].SectorIndex != 0 || placements[1].SectorIndex != 1 {
+		t.Fatalf("expected test2 alone in sector 0, got %v", placements)
+	}
+}
+
+// TestPackerPersist tests that packing can be resumed from a persisted Packer.
+func TestPackerPersist(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// Create two batches of files with unique sizes, where all files of the
+	// second batch are smaller than the files of the first batch. That way
+	// packing the batches one after another is equal to packing them all at
+	// once.
+	sizes := make(map[uint64]struct{})
+	uniqueSize := func(min, max uint64) uint64 {
+		for {
+			size := min + fastrand.Uint64n(max-min)
+			if _, exists := sizes[size]; !exists {
+				sizes[size] = struct{}{}
+				return size
+			}
+		}
+	}
+	batch1 := make(map[string]uint64)
+	batch2 := make(map[string]uint64)
+	allFiles := make(map[string]uint64)
+	for i := 0; i < 50; i++ {
+		id1, id2 := fmt.Sprintf("batch1_%v", i), fmt.Sprintf("batch2_%v", i)
+		batch1[id1] = uniqueSize(mib, SectorSize)
+		batch2[id2] = uniqueSize(1, mib)
+		allFiles[id1], allFiles[id2] = batch1[id1], batch2[id2]
+	}
+
+	// Pack the first batch and persist the packer.
+	p, err := NewPacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placements1, err := p.PackFiles(batch1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := p.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore the packer and pack the second batch.
+	p, err = LoadPacker(&buf, PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placements2, err := p.PackFiles(batch2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compare against packing all files at once.
+	placements, num, err := PackFiles(allFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(append(placements1, placements2...), placements) {
+		t.Fatal("resumed packing differs from packing all files at once")
+	}
+	if !reflect.DeepEqual(p.Placements(), placements) {
+		t.Fatal("restored packer doesn't track the placements of both batches")
+	}
+	if p.NumSectors() != num {
+		t.Fatalf("expected %v sectors, got %v", num, p.NumSectors())
+	}
+
+	// A failed batch shouldn't change the packer.
+	var before bytes.Buffer
+	if err := p.Persist(&before); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.PackFiles(map[string]uint64{"test1": 1, "test2": 0})
+	if err != ErrZeroSize {
+		t.Fatalf("expected %v, got %v", ErrZeroSize, err)
+	}
+	var after bytes.Buffer
+	if err := p.Persist(&after); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before.Bytes(), after.Bytes()) {
+		t.Fatal("failed batch changed the packer")
+	}
+
+	// Corrupt state should be rejected.
+	if _, err := LoadPacker(bytes.NewReader(before.Bytes()[:10]), PackConfig{}); err == nil {
+		t.Fatal("expected an error loading truncated state")
+	}
+
+	// State with a different header or version should be rejected.
+	state := append([]byte(nil), before.Bytes()...)
+	state[0]++
+	if _, err := LoadPacker(bytes.NewReader(state), PackConfig{}); !errors.Contains(err, persist.ErrBadHeader) {
+		t.Fatalf("expected %v, got %v", persist.ErrBadHeader, err)
+	}
+	state = append([]byte(nil), before.Bytes()...)
+	state[types.SpecifierLen]++
+	if _, err := LoadPacker(bytes.NewReader(state), PackConfig{}); !errors.Contains(err, persist.ErrBadVersion) {
+		t.Fatalf("expected %v, got %v", persist.ErrBadVersion, err)
+	}
+}
+
+// TestLoadPackerInvalidState tests that crafted states that would corrupt the
+// packing are rejected when loading a Packer.
+func TestLoadPackerInvalidState(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// newPacker returns a packer with a sector holding two files followed by
+	// a free bucket.
+	newPacker := func() *Packer {
+		p, err := NewPacker(PackConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.PackFiles(map[string]uint64{"test1": 3 * mib, "test2": 512 * kib}); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	load := func(p *Packer) error {
+		var buf bytes.Buffer
+		if err := p.Persist(&buf); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadPacker(&buf, PackConfig{})
+		return err
+	}
+
+	// The unmodified state loads.
+	if err := load(newPacker()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Packer)
+	}{
+		{"placement outside of the sectors", func(p *Packer) {
+			p.placements[0].SectorIndex = 5
+		}},
+		{"overlapping placements", func(p *Packer) {
+			p.placements[1] = p.placements[0]
+			p.placements[1].FileID = "test3"
+		}},
+		{"bucket outside of the sectors", func(p *Packer) {
+			p.buckets[0] = &bucket{5, 0, SectorSize}
+		}},
+		{"buckets out of order", func(p *Packer) {
+			p.buckets = append(p.buckets, &bucket{0, 0, kib})
+		}},
+		{"overlapping buckets", func(p *Packer) {
+			p.buckets = append(p.buckets, &bucket{p.buckets[0].sectorIndex, p.buckets[0].sectorOffset, kib})
+		}},
+		{"bucket overlapping a placement", func(p *Packer) {
+			fp := p.placements[0]
+			p.buckets = append(bucketList{&bucket{fp.SectorIndex, fp.SectorOffset + fp.Size - 1, kib}}, p.buckets...)
+		}},
+	}
+	for _, test := range tests {
+		p := newPacker()
+		test.modify(p)
+		if err := load(p); err == nil {
+			t.Errorf("%v: expected an error loading the state", test.name)
+		}
+	}
+}
+
+// TestPackerStats tests that the Packer counts the files placed into new
+// sectors and into existing buckets.
+func TestPackerStats(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	p, err := NewPacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// test2, test1 and test4 each require a new sector, the other files fit
+	// into the space left behind them.
+	placements, err := p.PackFiles(map[string]uint64{
+		"test1": 3 * mib,
+		"test2": 4 * mib,
+		"test3": 1 * mib,
+		"test4": 2 * mib,
+		"test5": 2e3 * kib,
+		"test6": 1,
+		"test7": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The utilization matches the one computed from the placements.
+	expected, err := ComputePackingStats(placements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.FilesInExistingBuckets = 4
+	expected.FilesInNewSectors = 3
+	if !reflect.DeepEqual(p.Stats(), expected) {
+		t.Fatalf("expected %v, got %v", expected, p.Stats())
+	}
+
+	// The stats accumulate across batches. This file doesn't fit into any of
+	// the existing sectors.
+	_, err = p.PackFiles(map[string]uint64{"test8": 3 * mib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.FilesInNewSectors++
+	expected.NumSectors++
+	expected.BytesUsed += 3 * mib
+	expected.BytesWasted += SectorSize - 3*mib
+	expected.SectorFill[3] = float64(3*mib) / float64(SectorSize)
+	if !reflect.DeepEqual(p.Stats(), expected) {
+		t.Fatalf("expected %v, got %v", expected, p.Stats())
+	}
+
+	// Removing a file frees its space, but keeps its sector and the file
+	// counts.
+	if err := p.RemoveFile("test8"); err != nil {
+		t.Fatal(err)
+	}
+	expected.BytesUsed -= 3 * mib
+	expected.BytesWasted += 3 * mib
+	delete(expected.SectorFill, 3)
+	if !reflect.DeepEqual(p.Stats(), expected) {
+		t.Fatalf("expected %v, got %v", expected, p.Stats())
+	}
+
+	// The stats are persisted.
+	var buf bytes.Buffer
+	if err := p.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p, err = LoadPacker(&buf, PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Stats(), expected) {
+		t.Fatalf("expected %v, got %v", expected, p.Stats())
+	}
+}
+
+// TestValidatePlacements tests that inconsistent placements are detected.
+func TestValidatePlacements(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	tests := []struct {
+		in    []FilePlacement
+		valid bool
+	}{
+		{in: nil, valid: true},
+		{
+			in: []FilePlacement{
+				{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: 0},
+				{FileID: "test2", Size: 10 * kib, SectorIndex: 0, SectorOffset: 12 * kib},
+				{FileID: "test3", Size: 10 * kib, SectorIndex: 1, SectorOffset: 0},
+			},
+			valid: true,
+		},
+		// Overlapping files.
+		{
+			in: []FilePlacement{
+				{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: 8 * kib},
+				{FileID: "test2", Size: 10 * kib, SectorIndex: 0, SectorOffset: 0},
+			},
+			valid: false,
+		},
+		// A file overlapping a file that isn't its direct neighbour.
+		{
+			in: []FilePlacement{
+				{FileID: "test1", Size: 100 * kib, SectorIndex: 0, SectorOffset: 0},
+				{FileID: "test2", Size: 4 * kib, SectorIndex: 0, SectorOffset: 4 * kib},
+				{FileID: "test3", Size: 4 * kib, SectorIndex: 0, SectorOffset: 12 * kib},
+			},
+			valid: false,
+		},
+		// Misaligned file.
+		{
+			in:    []FilePlacement{{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: kib}},
+			valid: false,
+		},
+		// File outside of its sector.
+		{
+			in:    []FilePlacement{{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: SectorSize - 8*kib}},
+			valid: false,
+		},
+		// File larger than a sector.
+		{
+			in:    []FilePlacement{{FileID: "test1", Size: SectorSize + 1, SectorIndex: 0, SectorOffset: 0}},
+			valid: false,
+		},
+		// File without a size.
+		{
+			in:    []FilePlacement{{FileID: "test1", Size: 0, SectorIndex: 0, SectorOffset: 0}},
+			valid: false,
+		},
+	}
 
-	// Check that all alignments are correct.
+	for _, test := range tests {
+		err := ValidatePlacements(test.in)
+		if test.valid && err != nil || !test.valid && err == nil {
+			t.Errorf("ValidatePlacements(%v): expected valid %v, got %v", test.in, test.valid, err)
+		}
+	}
+
+	// The page alignment of the config is enforced.
+	placements := []FilePlacement{{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: 4 * kib}}
+	if err := ValidatePlacements(placements); err != nil {
+		t.Fatal(err)
+	}
+	if err := (PackConfig{PageAlignment: 8 * kib}).ValidatePlacements(placements); !errors.Contains(err, ErrInvalidPlacements) {
+		t.Fatalf("expected %v, got %v", ErrInvalidPlacements, err)
+	}
+}
+
+// TestFilePlacementAbsoluteOffset tests that the absolute offset of a placement
+// accounts for the preceding sectors.
+func TestFilePlacementAbsoluteOffset(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	tests := []struct {
+		in  FilePlacement
+		out uint64
+	}{
+		{FilePlacement{SectorIndex: 0, SectorOffset: 0}, 0},
+		{FilePlacement{SectorIndex: 0, SectorOffset: 36 * kib}, 36 * kib},
+		{FilePlacement{SectorIndex: 1, SectorOffset: 0}, 4 * mib},
+		{FilePlacement{SectorIndex: 2, SectorOffset: 2*mib + 2e3*kib}, 10*mib + 2e3*kib},
+	}
+
+	for _, test := range tests {
+		res := test.in.AbsoluteOffset()
+		if res != test.out {
+			t.Errorf("AbsoluteOffset(%v): expected %v, got %v", test.in, test.out, res)
+		}
+	}
+
+	// Check the placements returned by PackFiles.
+	placements, _, err := PackFiles(randomFileMap(100))
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, p := range placements {
-		size := p.Size
-		requiredAlignment, err := requiredAlignment(size)
+		if p.AbsoluteOffset() != p.SectorIndex*SectorSize+p.SectorOffset {
+			t.Errorf("AbsoluteOffset(%v): expected %v, got %v", p, p.SectorIndex*SectorSize+p.SectorOffset, p.AbsoluteOffset())
+		}
+	}
+}
+
+// TestCanShareSector tests checking whether two files fit into the same sector.
+func TestCanShareSector(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	tests := []struct {
+		sizeA, sizeB uint64
+		out          bool
+	}{
+		{sizeA: 10 * kib, sizeB: 20 * kib, out: true},
+		{sizeA: 2 * mib, sizeB: 2 * mib, out: true},
+		{sizeA: 3 * mib, sizeB: 1 * mib, out: true},
+		{sizeA: 2 * mib, sizeB: 2*mib + 1, out: false},
+		// The sizes add up to a sector but the alignment of the second file
+		// pushes it out of the sector.
+		{sizeA: 3*mib + 1, sizeB: mib - 1, out: false},
+		{sizeA: SectorSize, sizeB: 1, out: false},
+		{sizeA: 0, sizeB: 1, out: false},
+		{sizeA: SectorSize + 1, sizeB: 1, out: false},
+	}
+
+	for _, test := range tests {
+		res := CanShareSector(test.sizeA, test.sizeB)
+		if res != test.out {
+			t.Errorf("CanShareSector(%v, %v): expected %v, got %v", test.sizeA, test.sizeB, test.out, res)
+		}
+		res = CanShareSector(test.sizeB, test.sizeA)
+		if res != test.out {
+			t.Errorf("CanShareSector(%v, %v): expected %v, got %v", test.sizeB, test.sizeA, test.out, res)
+		}
+	}
+
+	// Whenever PackFiles packs two files into a single sector, they must be
+	// able to share a sector.
+	for i := 0; i < 1e3; i++ {
+		sizeA, sizeB := fastrand.Uint64n(SectorSize)+1, fastrand.Uint64n(SectorSize)+1
+		_, num, err := PackFiles(map[string]uint64{"a": sizeA, "b": sizeB})
 		if err != nil {
 			t.Fatal(err)
 		}
+		if num == 1 && !CanShareSector(sizeA, sizeB) {
+			t.Errorf("CanShareSector(%v, %v): expected true", sizeA, sizeB)
+		}
+	}
+}
 
-		i, j := p.SectorOffset, p.SectorOffset+size-1
-		if i%requiredAlignment != 0 {
-			t.Errorf("invalid alignment for file size %v", size)
+// TestComputePackingStats tests computing the sector utilization of
+// placements.
+func TestComputePackingStats(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	placements, _, err := PackFiles(map[string]uint64{
+		"test1": 3 * mib,
+		"test2": 4 * mib,
+		"test3": 1 * mib,
+		"test4": 2 * mib,
+		"test5": 2e3 * kib,
+		"test6": 1,
+		"test7": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sectors 0 and 1 are full, sector 2 holds test4, test5, test6 and test7.
+	bytesUsed := 2*SectorSize + 2*mib + 2e3*kib + 3
+	expected := PackingStats{
+		NumSectors:  3,
+		BytesUsed:   bytesUsed,
+		BytesWasted: 3*SectorSize - bytesUsed,
+		SectorFill:  map[uint64]float64{0: 1, 1: 1, 2: float64(2*mib+2e3*kib+3) / float64(SectorSize)},
+	}
+	stats, err := ComputePackingStats(placements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %v, got %v", expected, stats)
+	}
+
+	// The alignment padding between files counts as wasted.
+	stats, err = ComputePackingStats([]FilePlacement{
+		{FileID: "test1", Size: 10 * kib, SectorIndex: 0, SectorOffset: 0},
+		{FileID: "test2", Size: 10 * kib, SectorIndex: 0, SectorOffset: 12 * kib},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesUsed != 20*kib || stats.BytesWasted != SectorSize-20*kib {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	// Empty sectors are left out of the sector fill, but count as wasted.
+	stats, err = ComputePackingStats([]FilePlacement{
+		{FileID: "test1", Size: SectorSize, SectorIndex: 2, SectorOffset: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumSectors != 3 || stats.BytesWasted != 2*SectorSize || !reflect.DeepEqual(stats.SectorFill, map[uint64]float64{2: 1}) {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	// Overlapping placements don't underflow the wasted bytes.
+	stats, err = ComputePackingStats([]FilePlacement{
+		{FileID: "test1", Size: SectorSize, SectorIndex: 0, SectorOffset: 0},
+		{FileID: "test2", Size: SectorSize, SectorIndex: 0, SectorOffset: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesUsed != 2*SectorSize || stats.BytesWasted != 0 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	// Placements larger than a sector or beyond the addressable sectors are
+	// rejected instead of overflowing.
+	for _, fp := range []FilePlacement{
+		{FileID: "test1", Size: SectorSize + 1},
+		{FileID: "test1", Size: 1, SectorIndex: 1 << 62},
+		{FileID: "test1", Size: 1, SectorIndex: math.MaxUint64},
+	} {
+		if _, err := ComputePackingStats([]FilePlacement{fp}); !errors.Contains(err, ErrInvalidPlacements) {
+			t.Errorf("ComputePackingStats(%v): expected %v, got %v", fp, ErrInvalidPlacements, err)
 		}
-		if j > SectorSize {
-			t.Errorf("placement outside sector: (%v, %v)", i, j)
+	}
+
+	// No placements use no sectors.
+	stats, err = ComputePackingStats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumSectors != 0 || stats.BytesUsed != 0 || stats.BytesWasted != 0 || len(stats.SectorFill) != 0 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+// TestFitsInSectors tests checking whether placements fit into a number of
+// sectors.
+func TestFitsInSectors(t *testing.T) {
+	placements, num, err := PackFiles(randomFileMap(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !FitsInSectors(placements, num) {
+		t.Errorf("placements should fit into %v sectors", num)
+	}
+	if !FitsInSectors(placements, num+1) {
+		t.Errorf("placements should fit into %v sectors", num+1)
+	}
+	if FitsInSectors(placements, num-1) {
+		t.Errorf("placements shouldn't fit into %v sectors", num-1)
+	}
+
+	tests := []struct {
+		in         []FilePlacement
+		maxSectors uint64
+		out        bool
+	}{
+		{in: nil, maxSectors: 0, out: true},
+		{in: []FilePlacement{{SectorIndex: 0}}, maxSectors: 0, out: false},
+		{in: []FilePlacement{{SectorIndex: 0}}, maxSectors: 1, out: true},
+		{in: []FilePlacement{{SectorIndex: 0}, {SectorIndex: 2}}, maxSectors: 2, out: false},
+		{in: []FilePlacement{{SectorIndex: 2}, {SectorIndex: 0}}, maxSectors: 3, out: true},
+	}
+	for _, test := range tests {
+		res := FitsInSectors(test.in, test.maxSectors)
+		if res != test.out {
+			t.Errorf("FitsInSectors(%v, %v): expected %v, got %v", test.in, test.maxSectors, test.out, res)
 		}
 	}
+}
 
-	// Check that there are no overlapping files.
-	for i, p1 := range placements {
-		for _, p2 := range placements[i+1:] {
-			s1, s2 := p1.SectorIndex, p2.SectorIndex
-			if s1 != s2 {
-				continue
-			}
+// TestLayoutChecksum tests that the checksum of a layout does not depend on the
+// order of the placements but changes with the layout.
+func TestLayoutChecksum(t *testing.T) {
+	placements, _, err := PackFiles(randomFileMap(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := LayoutChecksum(placements)
 
-			i1, i2 := p1.SectorOffset, p1.SectorOffset+p1.Size-1
-			j1, j2 := p2.SectorOffset, p2.SectorOffset+p2.Size-1
-			if overlaps(i1, i2, j1, j2) {
-				t.Errorf("overlapping files at sector%v:(%v, %v) and sector%v:(%v, %v)", s1, i1, i2, s2, j1, j2)
-			}
+	// Shuffle the placements. The checksum should be the same.
+	shuffled := append([]FilePlacement(nil), placements...)
+	for i, j := range fastrand.Perm(len(shuffled)) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	if LayoutChecksum(shuffled) != checksum {
+		t.Fatal("checksum changed after shuffling placements")
+	}
+	// The input should not have been modified.
+	if reflect.DeepEqual(shuffled, placements) {
+		t.Fatal("placements were not shuffled")
+	}
+
+	// Modifying any field of a placement should change the checksum.
+	modifications := []func(*FilePlacement){
+		func(p *FilePlacement) { p.FileID += "x" },
+		func(p *FilePlacement) { p.Size++ },
+		func(p *FilePlacement) { p.SectorIndex++ },
+		func(p *FilePlacement) { p.SectorOffset++ },
+	}
+	for i, modify := range modifications {
+		modified := append([]FilePlacement(nil), placements...)
+		modify(&modified[fastrand.Intn(len(modified))])
+		if LayoutChecksum(modified) == checksum {
+			t.Errorf("modification %v did not change the checksum", i)
+		}
+	}
+
+	// Removing a placement should change the checksum.
+	if LayoutChecksum(placements[1:]) == checksum {
+		t.Error("removing a placement did not change the checksum")
+	}
+}
+
+// TestPackBucketTooSmall tests that packing a file into a bucket it doesn't fit
+// into fails instead of underflowing.
+func TestPackBucketTooSmall(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	tests := []struct {
+		file   packingFile
+		bucket bucket
+	}{
+		// The file is larger than the bucket.
+		{packingFile{id: "test1", size: 10 * kib}, bucket{0, 0, 8 * kib}},
+		// The file fits, but not after alignment.
+		{packingFile{id: "test1", size: 8 * kib}, bucket{0, kib, 10 * kib}},
+	}
+	for _, test := range tests {
+		buckets := bucketList{&test.bucket}
+		_, res, err := packBucket(test.file, 0, buckets, PackConfig{})
+		if err != errBucketTooSmall {
+			t.Errorf("packBucket(%v, %v): expected %v, got %v", test.file, test.bucket, errBucketTooSmall, err)
+		}
+		if len(res) != 1 || *res[0] != test.bucket {
+			t.Errorf("packBucket(%v, %v): buckets were modified", test.file, test.bucket)
 		}
 	}
 }
@@ -246,6 +1877,38 @@ func BenchmarkPackFiles10000(b *testing.B) { benchmarkPackFiles(10e3, b) }
 // BenchPackFilesRandom benchmarks packing 100k random files.
 func BenchmarkPackFiles100000(b *testing.B) { benchmarkPackFiles(100e3, b) }
 
+func benchmarkPackStrategy(strategy PackStrategy, b *testing.B) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	var sumSectors uint64
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		files := logUniformFileMap(1e4)
+		b.StartTimer()
+		_, numSectors, err := PackFilesWithConfig(files, PackConfig{Strategy: strategy})
+		if err != nil {
+			b.Fatal(err)
+		}
+		sumSectors += numSectors
+	}
+	b.ReportMetric(float64(sumSectors)/float64(b.N), "sectors/op")
+}
+
+// BenchmarkPackStrategyWorstFit benchmarks packing 10k files with sizes
+// distributed log-uniformly using worst-fit.
+func BenchmarkPackStrategyWorstFit(b *testing.B) { benchmarkPackStrategy(PackStrategyWorstFit, b) }
+
+// BenchmarkPackStrategyFirstFit benchmarks packing 10k files with sizes
+// distributed log-uniformly using first-fit.
+func BenchmarkPackStrategyFirstFit(b *testing.B) { benchmarkPackStrategy(PackStrategyFirstFit, b) }
+
+// BenchmarkPackStrategyBestFit benchmarks packing 10k files with sizes
+// distributed log-uniformly using best-fit.
+func BenchmarkPackStrategyBestFit(b *testing.B) { benchmarkPackStrategy(PackStrategyBestFit, b) }
+
 // TestPackingUtilization generates a report of average % utilization (space
 // used / total space * 100) for large numbers of input files, randomly and
 // uniformly-distributed in size.
@@ -307,6 +1970,20 @@ func randomFileMap(numFiles int) map[string]uint64 {
 	return files
 }
 
+// logUniformFileMap generates a map of random files whose sizes are
+// log-uniformly distributed, so that small files are much more common than
+// large ones.
+func logUniformFileMap(numFiles int) map[string]uint64 {
+	files := make(map[string]uint64, numFiles)
+	maxExp := bits.Len64(SectorSize) - 1
+	for i := 0; i < numFiles; i++ {
+		name := string(fastrand.Bytes(16))
+		size := fastrand.Uint64n(1<<uint(fastrand.Intn(maxExp)+1)) + 1
+		files[name] = size
+	}
+	return files
+}
+
 // TestSortByFileSizeDescending tests that sorting a map by descending values
 // works correctly.
 func TestSortByFileSizeDescending(t *testing.T) {
@@ -322,13 +1999,36 @@ func TestSortByFileSizeDescending(t *testing.T) {
 			},
 			out: fileList{
 				packingFile{
-					"test2", 20,
+					id: "test2", size: 20,
+				},
+				packingFile{
+					id: "test3", size: 15,
+				},
+				packingFile{
+					id: "test1", size: 10,
+				},
+			},
+		},
+		// Files of equal size are ordered by ID.
+		{
+			in: map[string]uint64{
+				"test3": 10,
+				"test1": 10,
+				"test4": 20,
+				"test2": 10,
+			},
+			out: fileList{
+				packingFile{
+					id: "test4", size: 20,
+				},
+				packingFile{
+					id: "test1", size: 10,
 				},
 				packingFile{
-					"test3", 15,
+					id: "test2", size: 10,
 				},
 				packingFile{
-					"test1", 10,
+					id: "test3", size: 10,
 				},
 			},
 		},
@@ -342,6 +2042,49 @@ func TestSortByFileSizeDescending(t *testing.T) {
 	}
 }
 
+// TestSortFilesBySizeDescending tests that the exported sort returns the files
+// in the same order that PackFiles packs them.
+func TestSortFilesBySizeDescending(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	// Include files of equal size, which are ordered by their ID.
+	files := map[string]uint64{
+		"test1": 3 * mib,
+		"test2": 4 * mib,
+		"test3": 1 * mib,
+		"test4": 2 * mib,
+		"test5": 2e3 * kib,
+		"test6": 1,
+		"test7": 2,
+		"test8": 1 * mib,
+		"test9": 2,
+		"test0": 1 * mib,
+	}
+
+	sorted := SortFilesBySizeDescending(files)
+	expected := []string{"test2", "test1", "test4", "test5", "test0", "test3", "test8", "test7", "test9", "test6"}
+	for i, id := range expected {
+		if sorted[i].ID != id || sorted[i].Size != files[id] {
+			t.Errorf("file %v: expected %v %v, got %v %v", i, id, files[id], sorted[i].ID, sorted[i].Size)
+		}
+	}
+	placements, _, err := PackFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sorted) != len(placements) {
+		t.Fatalf("expected %v sorted files, got %v", len(placements), len(sorted))
+	}
+	for i, p := range placements {
+		if sorted[i].ID != p.FileID || sorted[i].Size != p.Size {
+			t.Errorf("file %v: expected %v %v, got %v %v", i, p.FileID, p.Size, sorted[i].ID, sorted[i].Size)
+		}
+	}
+}
+
 // TestFindBucket tests that the correct bucket is chosen given a file size and
 // a list of buckets.
 func TestFindBucket(t *testing.T) {
@@ -369,13 +2112,119 @@ func TestFindBucket(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		res, err := findBucket(test.fileSize, test.buckets)
+		res, err := findBucket(packingFile{size: test.fileSize}, test.buckets, PackConfig{})
 		if res != test.out || err != test.err {
 			t.Errorf("findBucket(%v, %v, %v): expected %v %v, got %v %v", test.fileSize, test.buckets, test.numSectors, test.out, test.err, res, err)
 		}
 	}
 }
 
+// TestPackerNoAdjacentBuckets tests that packing and removing files never
+// leaves adjacent buckets behind.
+func TestPackerNoAdjacentBuckets(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	checkBuckets := func(buckets bucketList) {
+		t.Helper()
+		for i := 1; i < len(buckets); i++ {
+			b1, b2 := buckets[i-1], buckets[i]
+			if b1.sectorIndex == b2.sectorIndex && b1.sectorOffset+b1.length >= b2.sectorOffset {
+				t.Fatalf("buckets %v and %v are adjacent", *b1, *b2)
+			}
+		}
+	}
+
+	p, err := NewPacker(PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placements, err := p.PackFiles(randomFileMap(1e3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBuckets(p.buckets)
+	for _, fp := range placements[:100] {
+		if err := p.RemoveFile(fp.FileID); err != nil {
+			t.Fatal(err)
+		}
+		checkBuckets(p.buckets)
+	}
+	if _, err := p.PackFiles(randomFileMap(100)); err != nil {
+		t.Fatal(err)
+	}
+	checkBuckets(p.buckets)
+
+	// Rebuilding the buckets from placements doesn't leave adjacent buckets
+	// either.
+	p, err = newPackerFromPlacements(p.Placements(), PackConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBuckets(p.buckets)
+}
+
+// TestFindBucketStrategy tests that the bucket is chosen according to the
+// packing strategy.
+func TestFindBucketStrategy(t *testing.T) {
+	// Test using the production sector size.
+	SectorSize = SectorSizeStandard
+	// Change the scaling as well.
+	alignmentScaling = uint64(1 << alignmentScalingStandard)
+
+	buckets := bucketList{
+		// Smallest bucket, but the file doesn't fit after alignment.
+		&bucket{3, 1 * kib, 11 * kib},
+		&bucket{0, 0, 20 * kib},
+		&bucket{0, 100 * kib, 12 * kib},
+		&bucket{1, 0, mib},
+		&bucket{2, 0, mib},
+	}
+	tests := []struct {
+		strategy PackStrategy
+		out      int
+	}{
+		{PackStrategyWorstFit, 3},
+		{PackStrategyFirstFit, 1},
+		{PackStrategyBestFit, 2},
+	}
+
+	for _, test := range tests {
+		res, err := findBucket(packingFile{size: 10 * kib}, buckets, PackConfig{Strategy: test.strategy})
+		if res != test.out || err != nil {
+			t.Errorf("findBucket with strategy %v: expected %v, got %v %v", test.strategy, test.out, res, err)
+		}
+	}
+
+	// No strategy finds a bucket for a file that doesn't fit anywhere.
+	for _, test := range tests {
+		_, err := findBucket(packingFile{size: 2 * mib}, buckets, PackConfig{Strategy: test.strategy})
+		if err != errBucketNotFound {
+			t.Errorf("findBucket with strategy %v: expected %v, got %v", test.strategy, errBucketNotFound, err)
+		}
+	}
+
+	// Unknown strategies are rejected.
+	_, _, err := PackFilesWithConfig(randomFileMap(10), PackConfig{Strategy: PackStrategyBestFit + 1})
+	if err != ErrInvalidPackStrategy {
+		t.Fatalf("expected %v, got %v", ErrInvalidPackStrategy, err)
+	}
+
+	// All strategies produce aligned, non-overlapping placements.
+	files := logUniformFileMap(1e3)
+	for _, test := range tests {
+		placements, _, err := PackFilesWithConfig(files, PackConfig{Strategy: test.strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidatePlacements(placements); err != nil {
+			t.Fatalf("invalid placements with strategy %v: %v", test.strategy, err)
+		}
+	}
+}
+
 // TestRequiredAlignment tests that the correct alignment is chosen based on the
 // size of the file.
 func TestRequiredAlignment(t *testing.T) {
@@ -420,7 +2269,7 @@ func TestAlignFileInBucket(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		res, err := alignFileInBucket(test.fileSize, test.sectorOffset)
+		res, err := alignFileInBucket(test.fileSize, test.sectorOffset, PackConfig{})
 		if res != test.out || err != test.err {
 			t.Errorf("AlignFileInBucket(%v, %v): expected %v %v, got %v %v", test.fileSize, test.sectorOffset, test.out, test.err, res, err)
 		}